@@ -0,0 +1,69 @@
+package binprot
+
+import "testing"
+
+func TestManifestBuilderRecordsChunksAndEmptyFiles(t *testing.T) {
+	builder := newManifestBuilder(2)
+	builder.recordChunk(chunkResult{
+		job:   chunkJob{rank: 0, relPath: "col/data", offset: 0, size: backupChunkSize},
+		crc32: 111,
+	})
+	builder.recordChunk(chunkResult{
+		job:   chunkJob{rank: 0, relPath: "col/data", offset: backupChunkSize, size: 10},
+		crc32: 222,
+	})
+	builder.recordEmptyFile(0, "col/empty")
+
+	files := builder.ranks[0].Files
+	dataFM, exists := files["col/data"]
+	if !exists {
+		t.Fatal("expected a manifest entry for col/data")
+	}
+	if len(dataFM.ChunkCRC32) != 2 || dataFM.ChunkCRC32[0] != 111 || dataFM.ChunkCRC32[1] != 222 {
+		t.Fatalf("unexpected chunk CRCs: %v", dataFM.ChunkCRC32)
+	}
+	if dataFM.Size != backupChunkSize+10 {
+		t.Fatalf("expected size %d, got %d", backupChunkSize+10, dataFM.Size)
+	}
+
+	emptyFM, exists := files["col/empty"]
+	if !exists {
+		t.Fatal("expected a manifest entry for the zero-length file col/empty - without one, RestoreDB silently drops it")
+	}
+	if emptyFM.Size != 0 || len(emptyFM.ChunkCRC32) != 0 {
+		t.Fatalf("expected an empty file manifest entry, got %#v", emptyFM)
+	}
+}
+
+// TestCollectChunkResultsDrainsPastWorkerCount makes sure collectChunkResults
+// keeps draining the results channel past more failures than there are
+// backup workers, instead of stopping at the first error - a worker pool
+// sized smaller than the failure count must never deadlock trying to report
+// every failure.
+func TestCollectChunkResultsDrainsPastWorkerCount(t *testing.T) {
+	builder := newManifestBuilder(1)
+	results := make(chan chunkResult)
+	done := make(chan error, 1)
+	go func() {
+		done <- collectChunkResults(results, builder)
+	}()
+	const failureCount = 20 // more than any realistic worker pool size
+	for i := 0; i < failureCount; i++ {
+		results <- chunkResult{job: chunkJob{rank: 0, relPath: "broken"}, err: errTestChunk}
+	}
+	results <- chunkResult{job: chunkJob{rank: 0, relPath: "ok", size: 1}, crc32: 1}
+	close(results)
+	err := <-done
+	if err == nil {
+		t.Fatal("expected collectChunkResults to report the chunk failures")
+	}
+	if _, exists := builder.ranks[0].Files["ok"]; !exists {
+		t.Fatal("expected the successful chunk after the failures to still be recorded")
+	}
+}
+
+type testChunkError string
+
+func (e testChunkError) Error() string { return string(e) }
+
+const errTestChunk = testChunkError("simulated chunk failure")
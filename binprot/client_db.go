@@ -14,26 +14,42 @@ import (
 	"time"
 )
 
-func (client *BinProtClient) forAllDBsDo(fun func(*db.DB) error) error {
-	for i := 0; i < client.nProcs; i++ {
-		clientDB, err := db.OpenDB(path.Join(client.workspace, strconv.Itoa(i)))
-		if err != nil {
-			return err
-		} else if err = fun(clientDB); err != nil {
-			return err
-		} else if err = clientDB.Close(); err != nil {
-			return err
-		}
-	}
-	return nil
+// CreateOpts customizes collection creation, currently just which Codec
+// Scrub and Index pass the collection's documents through. Creating the
+// collection on the servers and storing its documents do not use the codec.
+type CreateOpts struct {
+	Codec string
 }
 
-// Create a new collection.
-func (client *BinProtClient) Create(colName string) error {
+// Create a new collection. An optional CreateOpts picks the document
+// codec (see codec.go); with none given, a codec selected via WithCodec
+// is used if present, otherwise collections default to the JSON codec.
+// A shard that fails to create the collection triggers Drop on every
+// shard that already succeeded, so Create is atomic across the workspace.
+func (client *BinProtClient) Create(colName string, opts ...CreateOpts) error {
+	var codecName string
+	if len(opts) > 0 && opts[0].Codec != "" {
+		codecName = opts[0].Codec
+	} else {
+		codecName = client.takePendingCodec()
+	}
+	rollback := func(i int, clientDB *db.DB) error {
+		return clientDB.Drop(colName)
+	}
 	return client.reqMaintAccess(func() error {
-		return client.forAllDBsDo(func(clientDB *db.DB) error {
+		err := client.forAllDBsDo(func(i int, clientDB *db.DB) error {
 			return clientDB.Create(colName)
-		})
+		}, ShardOpts{Rollback: rollback})
+		if err != nil {
+			return err
+		}
+		payload := struct{ Name, Codec string }{colName, codecName}
+		if err := client.commitReplication(OP_CREATE_COL, payload, func() error {
+			return client.forAllDBsDo(rollback, ShardOpts{})
+		}); err != nil {
+			return err
+		}
+		return client.setColCodec(colName, codecName)
 	})
 }
 
@@ -52,21 +68,38 @@ func (client *BinProtClient) AllCols() (names []string) {
 	return
 }
 
-// Rename a collection.
+// Rename a collection. If a shard fails partway through, every shard that
+// already renamed is renamed back so no shard is left on the new name
+// alone.
 func (client *BinProtClient) Rename(oldName, newName string) error {
+	rollback := func(i int, clientDB *db.DB) error {
+		return clientDB.Rename(newName, oldName)
+	}
 	return client.reqMaintAccess(func() error {
-		return client.forAllDBsDo(func(clientDB *db.DB) error {
+		err := client.forAllDBsDo(func(i int, clientDB *db.DB) error {
 			return clientDB.Rename(oldName, newName)
+		}, ShardOpts{Rollback: rollback})
+		if err != nil {
+			return err
+		}
+		payload := struct{ OldName, NewName string }{oldName, newName}
+		return client.commitReplication(OP_RENAME_COL, payload, func() error {
+			return client.forAllDBsDo(rollback, ShardOpts{})
 		})
 	})
 }
 
-// Truncate a collection
+// Truncate a collection. There is nothing to roll back - once a shard's
+// documents are gone, a failure on a later shard cannot bring them back.
 func (client *BinProtClient) Truncate(colName string) error {
 	return client.reqMaintAccess(func() error {
-		return client.forAllDBsDo(func(clientDB *db.DB) error {
+		err := client.forAllDBsDo(func(i int, clientDB *db.DB) error {
 			return clientDB.Truncate(colName)
-		})
+		}, ShardOpts{})
+		if err != nil {
+			return err
+		}
+		return client.commitReplication(OP_TRUNCATE_COL, struct{ Name string }{colName}, nil)
 	})
 }
 
@@ -82,9 +115,14 @@ func (client *BinProtClient) Scrub(colName string) error {
 		for _, existingIndex := range client.schema.indexPaths[colID] {
 			existingIndexes = append(existingIndexes, existingIndex)
 		}
-		// Create a temporary collection for holding good&clean documents
+		// Create a temporary collection for holding good&clean documents,
+		// using the same codec as the collection being scrubbed.
+		codec := client.colCodec(colName)
 		tmpColName := fmt.Sprintf("scrub-%s-%d", colName, time.Now().UnixNano())
-		err := client.forAllDBsDo(func(clientDB *db.DB) error {
+		if err := client.setColCodec(tmpColName, codec.Name()); err != nil {
+			return err
+		}
+		err := client.forAllDBsDo(func(i int, clientDB *db.DB) error {
 			if err := clientDB.Create(tmpColName); err != nil {
 				return err
 			}
@@ -95,6 +133,10 @@ func (client *BinProtClient) Scrub(colName string) error {
 				}
 			}
 			return nil
+		}, ShardOpts{
+			Rollback: func(i int, clientDB *db.DB) error {
+				return clientDB.Drop(tmpColName)
+			},
 		})
 		// Reload schema so that servers & client know the temp collection
 		if err != nil {
@@ -112,83 +154,113 @@ func (client *BinProtClient) Scrub(colName string) error {
 			return err
 		}
 		total := docCount/10000 + 1
+		skipped := 0
 		for page := uint64(0); page < total; page++ {
 			docs, err := client.getDocPage(colName, page, total, true)
 			if err != nil {
 				return err
 			}
 			for docID, doc := range docs {
-				if err := client.insertRecovery(tmpColID, docID, doc); err != nil {
+				// Round-trip every document through the collection's own
+				// codec before putting it back - a document that fails to
+				// encode or decode is exactly the kind of corruption Scrub
+				// exists to recover from, so it is dropped rather than
+				// aborting the whole scrub.
+				encoded, err := codec.Encode(doc)
+				if err != nil {
+					tdlog.Noticef("Scrub %s: dropping document %d, failed to encode via codec %s - %v", colName, docID, codec.Name(), err)
+					skipped++
+					continue
+				}
+				decoded, err := codec.Decode(encoded)
+				if err != nil {
+					tdlog.Noticef("Scrub %s: dropping document %d, failed to decode via codec %s - %v", colName, docID, codec.Name(), err)
+					skipped++
+					continue
+				}
+				decodedMap, isMap := decoded.(map[string]interface{})
+				if !isMap {
+					tdlog.Noticef("Scrub %s: dropping document %d, codec %s decoded a non-object value", colName, docID, codec.Name())
+					skipped++
+					continue
+				}
+				if err := client.insertRecovery(tmpColID, docID, decodedMap); err != nil {
 					return err
 				}
 			}
 		}
-		// Replace the original collection by the good&clean one
-		err = client.forAllDBsDo(func(clientDB *db.DB) error {
+		if skipped > 0 {
+			tdlog.Noticef("Scrub %s: dropped %d document(s) that did not round-trip through codec %s", colName, skipped, codec.Name())
+		}
+		// Replace the original collection by the good&clean one. There is
+		// no safe rollback here: once a shard has dropped the original,
+		// the only way back is the tmp collection it is about to swap in.
+		err = client.forAllDBsDo(func(i int, clientDB *db.DB) error {
 			if err := clientDB.Drop(colName); err != nil {
 				return err
 			} else if err := clientDB.Rename(tmpColName, colName); err != nil {
 				return err
 			}
 			return nil
-		})
+		}, ShardOpts{})
 		if err != nil {
 			return err
 		} else if err = client.reloadServer(); err != nil {
 			return err
 		}
-		return nil
+		if err := client.setColCodec(colName, codec.Name()); err != nil {
+			return err
+		}
+		return client.commitReplication(OP_SCRUB, struct{ Name string }{colName}, nil)
 	})
 }
 
-// Drop a collection.
+// Drop a collection. Nothing to roll back - a partially dropped
+// collection cannot be un-dropped.
 func (client *BinProtClient) Drop(colName string) error {
 	return client.reqMaintAccess(func() error {
-		for i := 0; i < client.nProcs; i++ {
-			if clientDB, err := db.OpenDB(path.Join(client.workspace, strconv.Itoa(i))); err != nil {
-				return err
-			} else if err = clientDB.Drop(colName); err != nil {
-				return err
-			} else if err = clientDB.Close(); err != nil {
-				return err
-			}
+		err := client.forAllDBsDo(func(i int, clientDB *db.DB) error {
+			return clientDB.Drop(colName)
+		}, ShardOpts{})
+		if err != nil {
+			return err
 		}
-		return nil
+		return client.commitReplication(OP_DROP_COL, struct{ Name string }{colName}, nil)
 	})
 }
 
 // Copy database into destination directory (for backup).
 func (client *BinProtClient) DumpDB(destDir string) error {
 	return client.reqMaintAccess(func() error {
-		for i := 0; i < client.nProcs; i++ {
+		return client.forAllDBsDo(func(i int, clientDB *db.DB) error {
 			destDirPerRank := path.Join(destDir, strconv.Itoa(i))
 			if err := os.MkdirAll(destDirPerRank, 0700); err != nil {
 				return err
-			} else if clientDB, err := db.OpenDB(path.Join(client.workspace, strconv.Itoa(i))); err != nil {
-				return err
-			} else if err = clientDB.Dump(destDirPerRank); err != nil {
-				return err
-			} else if err = clientDB.Close(); err != nil {
-				return err
 			}
-		}
-		return nil
+			return clientDB.Dump(destDirPerRank)
+		}, ShardOpts{})
 	})
 }
 
-// Create an index.
+// Create an index. If indexing fails on one shard after others already
+// succeeded, Unindex is run on those shards so the collection is not left
+// with the new index on only some of them.
 func (client *BinProtClient) Index(colName string, idxPath []string) error {
+	rollback := func(i int, clientDB *db.DB) error {
+		if clientDB.Use(colName) == nil {
+			return nil
+		}
+		return clientDB.Use(colName).Unindex(idxPath)
+	}
 	return client.reqMaintAccess(func() error {
-		for i := 0; i < client.nProcs; i++ {
-			if clientDB, err := db.OpenDB(path.Join(client.workspace, strconv.Itoa(i))); err != nil {
-				return err
-			} else if clientDB.Use(colName) == nil {
+		err := client.forAllDBsDo(func(i int, clientDB *db.DB) error {
+			if clientDB.Use(colName) == nil {
 				return fmt.Errorf("Collection does not exist")
-			} else if err = clientDB.Use(colName).BPIndex(idxPath); err != nil {
-				return err
-			} else if err = clientDB.Close(); err != nil {
-				return err
 			}
+			return clientDB.Use(colName).BPIndex(idxPath)
+		}, ShardOpts{Rollback: rollback})
+		if err != nil {
+			return err
 		}
 		// Refresh schema on server and myself
 		if err := client.reloadServer(); err != nil {
@@ -201,6 +273,7 @@ func (client *BinProtClient) Index(colName string, idxPath []string) error {
 		}
 		htIDBytes := Bint32(newHTID)
 		// Reindex documents - 10k at a time
+		codec := client.colCodec(colName)
 		docCount, err := client.approxDocCount(colName)
 		if err != nil {
 			return err
@@ -214,7 +287,11 @@ func (client *BinProtClient) Index(colName string, idxPath []string) error {
 			// A simplified client.indexDoc
 			for docID, doc := range docs {
 				docIDBytes := Buint64(docID)
-				for _, val := range db.GetIn(doc, idxPath) {
+				encoded, err := codec.Encode(doc)
+				if err != nil {
+					return err
+				}
+				for _, val := range codec.GetIn(encoded, idxPath) {
 					if val != nil {
 						htKey := db.StrHash(fmt.Sprint(val))
 						if _, _, err := client.sendCmd(int(htKey%uint64(client.nProcs)), false, C_HT_PUT, htIDBytes, Buint64(htKey), docIDBytes); err != nil {
@@ -224,7 +301,13 @@ func (client *BinProtClient) Index(colName string, idxPath []string) error {
 				}
 			}
 		}
-		return nil
+		payload := struct {
+			Col  string
+			Path []string
+		}{colName, idxPath}
+		return client.commitReplication(OP_INDEX, payload, func() error {
+			return client.forAllDBsDo(rollback, ShardOpts{})
+		})
 	})
 }
 
@@ -262,20 +345,23 @@ func (client *BinProtClient) AllIndexesJointPaths(colName string) (paths []strin
 	return
 }
 
-// Remove an index.
+// Remove an index. Nothing to roll back - once index data is removed on a
+// shard, it would have to be fully rebuilt, which Unindex does not do.
 func (client *BinProtClient) Unindex(colName string, idxPath []string) error {
 	return client.reqMaintAccess(func() error {
-		for i := 0; i < client.nProcs; i++ {
-			if clientDB, err := db.OpenDB(path.Join(client.workspace, strconv.Itoa(i))); err != nil {
-				return err
-			} else if clientDB.Use(colName) == nil {
-				continue
-			} else if err = clientDB.Use(colName).Unindex(idxPath); err != nil {
-				return err
-			} else if err = clientDB.Close(); err != nil {
-				return err
+		err := client.forAllDBsDo(func(i int, clientDB *db.DB) error {
+			if clientDB.Use(colName) == nil {
+				return nil
 			}
+			return clientDB.Use(colName).Unindex(idxPath)
+		}, ShardOpts{})
+		if err != nil {
+			return err
 		}
-		return nil
+		payload := struct {
+			Col  string
+			Path []string
+		}{colName, idxPath}
+		return client.commitReplication(OP_UNINDEX, payload, nil)
 	})
 }
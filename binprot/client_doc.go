@@ -0,0 +1,159 @@
+// Binary protocol over IPC - document CRUD (client).
+
+package binprot
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+// nextDocShard round-robins new documents across shards, keyed by
+// workspace, so inserts spread evenly instead of always landing on shard 0.
+var (
+	nextDocShard   = make(map[string]int)
+	nextDocShardMu sync.Mutex
+)
+
+func (client *BinProtClient) pickInsertShard() int {
+	nextDocShardMu.Lock()
+	defer nextDocShardMu.Unlock()
+	shard := nextDocShard[client.workspace] % client.nProcs
+	nextDocShard[client.workspace]++
+	return shard
+}
+
+// docShard returns the rank shard a document with the given ID lives on -
+// the same id % nProcs scheme Scrub's insertRecovery relies on to put
+// recovered documents back on the shard they started on.
+func (client *BinProtClient) docShard(id int) int {
+	return id % client.nProcs
+}
+
+// Insert adds doc to colName on a round-robin shard and returns its new
+// document ID. The insert is appended to the replication log so followers
+// started via FollowFrom receive the document, not just schema changes; if
+// that append fails, the document is deleted back out so a replication
+// failure does not leave data nothing else knows about.
+func (client *BinProtClient) Insert(colName string, doc map[string]interface{}) (id int, err error) {
+	rank := client.pickInsertShard()
+	err = client.runOnShard(rank, func(i int, clientDB *db.DB) error {
+		col := clientDB.Use(colName)
+		if col == nil {
+			return fmt.Errorf("Collection %s does not exist", colName)
+		}
+		id, err = col.Insert(doc)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	payload := struct {
+		Col string
+		ID  int
+		Doc map[string]interface{}
+	}{colName, id, doc}
+	rollback := func() error { return client.applyDelete(colName, id) }
+	if err := client.commitReplication(OP_DOC_INSERT, payload, rollback); err != nil {
+		return id, err
+	}
+	return id, nil
+}
+
+// Update replaces the document identified by id in colName with doc. Like
+// Insert, the mutation is rolled back if appending it to the replication
+// log fails.
+func (client *BinProtClient) Update(colName string, id int, doc map[string]interface{}) error {
+	rank := client.docShard(id)
+	var oldDoc map[string]interface{}
+	err := client.runOnShard(rank, func(i int, clientDB *db.DB) error {
+		col := clientDB.Use(colName)
+		if col == nil {
+			return fmt.Errorf("Collection %s does not exist", colName)
+		}
+		var readErr error
+		oldDoc, readErr = col.Read(id)
+		if readErr != nil {
+			return readErr
+		}
+		return col.Update(id, doc)
+	})
+	if err != nil {
+		return err
+	}
+	payload := struct {
+		Col string
+		ID  int
+		Doc map[string]interface{}
+	}{colName, id, doc}
+	rollback := func() error { return client.applyUpdate(colName, id, oldDoc) }
+	return client.commitReplication(OP_DOC_UPDATE, payload, rollback)
+}
+
+// Delete removes the document identified by id from colName. Like Insert
+// and Update, the mutation is rolled back if appending it to the
+// replication log fails.
+func (client *BinProtClient) Delete(colName string, id int) error {
+	rank := client.docShard(id)
+	var oldDoc map[string]interface{}
+	err := client.runOnShard(rank, func(i int, clientDB *db.DB) error {
+		col := clientDB.Use(colName)
+		if col == nil {
+			return fmt.Errorf("Collection %s does not exist", colName)
+		}
+		var readErr error
+		oldDoc, readErr = col.Read(id)
+		if readErr != nil {
+			return readErr
+		}
+		return col.Delete(id)
+	})
+	if err != nil {
+		return err
+	}
+	payload := struct {
+		Col string
+		ID  int
+	}{colName, id}
+	rollback := func() error { return client.applyInsertAt(colName, id, oldDoc) }
+	return client.commitReplication(OP_DOC_DELETE, payload, rollback)
+}
+
+// applyInsertAt inserts doc back at exactly id, for use by Delete's
+// rollback and by ReplicaApplier, both of which need the document to land
+// on the same ID it originally had rather than whatever ID a plain Insert
+// would pick next.
+func (client *BinProtClient) applyInsertAt(colName string, id int, doc map[string]interface{}) error {
+	colID, exists := client.schema.colNameLookup[colName]
+	if !exists {
+		return fmt.Errorf("Collection %s does not exist", colName)
+	}
+	return client.insertRecovery(colID, id, doc)
+}
+
+// applyUpdate replays an update at id without touching the replication
+// log, for use by Update's rollback and by ReplicaApplier.
+func (client *BinProtClient) applyUpdate(colName string, id int, doc map[string]interface{}) error {
+	rank := client.docShard(id)
+	return client.runOnShard(rank, func(i int, clientDB *db.DB) error {
+		col := clientDB.Use(colName)
+		if col == nil {
+			return fmt.Errorf("Collection %s does not exist", colName)
+		}
+		return col.Update(id, doc)
+	})
+}
+
+// applyDelete replays a delete of id without touching the replication log,
+// for use by Insert's rollback and by ReplicaApplier.
+func (client *BinProtClient) applyDelete(colName string, id int) error {
+	rank := client.docShard(id)
+	return client.runOnShard(rank, func(i int, clientDB *db.DB) error {
+		col := clientDB.Use(colName)
+		if col == nil {
+			return nil
+		}
+		return col.Delete(id)
+	})
+}
@@ -0,0 +1,527 @@
+// Binary protocol over IPC - pluggable document codecs (client).
+
+package binprot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/db"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+// Codec turns documents into bytes and back, and extracts index path
+// values from the encoded form. Scrub and Index go through whichever codec
+// a collection was created with. Both built-in codecs' GetIn decode the
+// whole document into Go values before walking the path.
+type Codec interface {
+	Name() string
+	Encode(doc interface{}) ([]byte, error)
+	Decode(raw []byte) (interface{}, error)
+	GetIn(raw []byte, path []string) []interface{}
+}
+
+var codecs = map[string]Codec{
+	"json": jsonCodec{},
+	"bson": bsonCodec{},
+}
+
+// DefaultCodecName is used for collections created without an explicit
+// CreateOpts.Codec, preserving today's plain-JSON behavior.
+const DefaultCodecName = "json"
+
+func codecByName(name string) Codec {
+	if name == "" {
+		return codecs[DefaultCodecName]
+	}
+	if c, exists := codecs[name]; exists {
+		return c
+	}
+	return codecs[DefaultCodecName]
+}
+
+// codecRegistryCol is the collection used to durably record which codec
+// each collection was created with, so the choice survives a process
+// restart - colCodecs below is only an in-memory cache over it.
+const codecRegistryCol = "_codec_registry"
+
+// codecRegistryRecord is one document stored in codecRegistryCol.
+type codecRegistryRecord struct {
+	Collection string `json:"collection"`
+	Codec      string `json:"codec"`
+}
+
+// colCodecs caches codec choices already looked up this process, keyed by
+// workspace then collection name, so colCodec does not have to open the
+// rank-0 database on every call.
+var (
+	colCodecs   = make(map[string]map[string]string)
+	colCodecsMu sync.Mutex
+)
+
+// setColCodec records that colName uses the codec codecName, durably in
+// codecRegistryCol and in the in-memory cache. It is not rolled back if the
+// caller's own operation later fails, for the same reason writeVersionRecord
+// is not: the registry only has to reflect what codec a collection was
+// written with, and Create/Scrub's own rollback already undoes the
+// collection itself.
+func (client *BinProtClient) setColCodec(colName, codecName string) error {
+	if err := client.persistColCodec(colName, codecName); err != nil {
+		return err
+	}
+	colCodecsMu.Lock()
+	defer colCodecsMu.Unlock()
+	if colCodecs[client.workspace] == nil {
+		colCodecs[client.workspace] = make(map[string]string)
+	}
+	colCodecs[client.workspace][colName] = codecName
+	return nil
+}
+
+// persistColCodec inserts a codecRegistryRecord into rank 0, mirroring how
+// writeVersionRecord records schema versions - the registry is workspace-wide,
+// not per-shard, so it lives alongside _schema_version rather than being
+// duplicated across every rank.
+func (client *BinProtClient) persistColCodec(colName, codecName string) error {
+	rankDB, err := client.rank0DB()
+	if err != nil {
+		return err
+	}
+	defer rankDB.Close()
+	if rankDB.Use(codecRegistryCol) == nil {
+		if err := rankDB.Create(codecRegistryCol); err != nil {
+			return err
+		}
+	}
+	doc, err := codecRegistryRecordToDoc(codecRegistryRecord{Collection: colName, Codec: codecName})
+	if err != nil {
+		return err
+	}
+	_, err = rankDB.Use(codecRegistryCol).Insert(doc)
+	return err
+}
+
+// loadColCodec reads the most recently recorded codec choice for colName
+// from codecRegistryCol, returning "" if none was ever recorded.
+func (client *BinProtClient) loadColCodec(colName string) (string, error) {
+	rankDB, err := client.rank0DB()
+	if err != nil {
+		return "", err
+	}
+	defer rankDB.Close()
+	col := rankDB.Use(codecRegistryCol)
+	if col == nil {
+		return "", nil
+	}
+	codecName := ""
+	err = col.ForEachDoc(func(id int, docContent []byte) bool {
+		rec, decodeErr := decodeCodecRegistryRecord(docContent)
+		if decodeErr == nil && rec.Collection == colName {
+			codecName = rec.Codec
+		}
+		return true
+	})
+	return codecName, err
+}
+
+func codecRegistryRecordToDoc(rec codecRegistryRecord) (map[string]interface{}, error) {
+	encoded, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal(encoded, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func decodeCodecRegistryRecord(docContent []byte) (codecRegistryRecord, error) {
+	rec := codecRegistryRecord{}
+	err := json.Unmarshal(docContent, &rec)
+	return rec, err
+}
+
+// colCodec returns the Codec a collection was created with, consulting the
+// in-memory cache first and falling back to codecRegistryCol - which
+// survives a process restart, unlike the cache alone - on a miss.
+// Collections with no recorded choice default to the JSON codec.
+func (client *BinProtClient) colCodec(colName string) Codec {
+	colCodecsMu.Lock()
+	name, cached := colCodecs[client.workspace][colName]
+	colCodecsMu.Unlock()
+	if cached {
+		return codecByName(name)
+	}
+	name, err := client.loadColCodec(colName)
+	if err != nil {
+		tdlog.Noticef("colCodec: failed to load durable codec choice for %s, defaulting to %s - %v", colName, DefaultCodecName, err)
+		return codecByName("")
+	}
+	colCodecsMu.Lock()
+	if colCodecs[client.workspace] == nil {
+		colCodecs[client.workspace] = make(map[string]string)
+	}
+	colCodecs[client.workspace][colName] = name
+	colCodecsMu.Unlock()
+	return codecByName(name)
+}
+
+// pendingCodecs holds the codec a caller selected via WithCodec, applied
+// to the very next Create call made without an explicit CreateOpts.
+var (
+	pendingCodecs   = make(map[*BinProtClient]string)
+	pendingCodecsMu sync.Mutex
+)
+
+// WithCodec selects the codec used by the next Create call that does not
+// pass its own CreateOpts, and returns client so calls can be chained:
+// client.WithCodec("bson").Create("orders").
+func (client *BinProtClient) WithCodec(name string) *BinProtClient {
+	pendingCodecsMu.Lock()
+	defer pendingCodecsMu.Unlock()
+	pendingCodecs[client] = name
+	return client
+}
+
+func (client *BinProtClient) takePendingCodec() string {
+	pendingCodecsMu.Lock()
+	defer pendingCodecsMu.Unlock()
+	name := pendingCodecs[client]
+	delete(pendingCodecs, client)
+	return name
+}
+
+// jsonCodec is today's behavior: documents round-trip through
+// map[string]interface{} via encoding/json.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Encode(doc interface{}) ([]byte, error) {
+	return json.Marshal(doc)
+}
+
+func (jsonCodec) Decode(raw []byte) (interface{}, error) {
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (c jsonCodec) GetIn(raw []byte, path []string) []interface{} {
+	doc, err := c.Decode(raw)
+	if err != nil {
+		return nil
+	}
+	return db.GetIn(doc, path)
+}
+
+// ObjectID is a 12-byte BSON ObjectId.
+type ObjectID [12]byte
+
+// bsonCodec implements just enough of BSON to round-trip the document
+// shapes tiedot cares about: objects, arrays, strings, int32/int64,
+// double, binary, UTC datetime, and ObjectId. It is not a full BSON
+// implementation (no decimal128, regex, JS code, etc).
+type bsonCodec struct{}
+
+func (bsonCodec) Name() string { return "bson" }
+
+func (bsonCodec) Encode(doc interface{}) ([]byte, error) {
+	return bsonEncodeDocument(doc)
+}
+
+func (bsonCodec) Decode(raw []byte) (interface{}, error) {
+	doc, _, err := bsonDecodeDocument(raw, 0)
+	return doc, err
+}
+
+func (c bsonCodec) GetIn(raw []byte, path []string) []interface{} {
+	doc, err := c.Decode(raw)
+	if err != nil {
+		return nil
+	}
+	return db.GetIn(doc, path)
+}
+
+const (
+	bsonDouble              = 0x01
+	bsonString              = 0x02
+	bsonDocument            = 0x03
+	bsonArray               = 0x04
+	bsonBinary              = 0x05
+	bsonObjectID            = 0x07
+	bsonBool                = 0x08
+	bsonDatetime            = 0x09
+	bsonNull                = 0x0A
+	bsonInt32               = 0x10
+	bsonInt64               = 0x12
+	bsonGenericSubtype byte = 0x00
+)
+
+// bsonEncodeDocument encodes a map[string]interface{} (or []interface{}
+// for arrays) into a BSON document's bytes, including its length prefix
+// and terminating null.
+func bsonEncodeDocument(doc interface{}) ([]byte, error) {
+	var elements bytes.Buffer
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			encoded, err := bsonEncodeElement(key, val)
+			if err != nil {
+				return nil, err
+			}
+			elements.Write(encoded)
+		}
+	case []interface{}:
+		for i, val := range v {
+			encoded, err := bsonEncodeElement(fmt.Sprint(i), val)
+			if err != nil {
+				return nil, err
+			}
+			elements.Write(encoded)
+		}
+	default:
+		return nil, fmt.Errorf("bsonEncodeDocument: unsupported top-level type %T", doc)
+	}
+	total := 4 + elements.Len() + 1
+	out := make([]byte, 4, total)
+	binary.LittleEndian.PutUint32(out, uint32(total))
+	out = append(out, elements.Bytes()...)
+	out = append(out, 0x00)
+	return out, nil
+}
+
+func bsonEncodeElement(key string, val interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	switch v := val.(type) {
+	case nil:
+		buf.WriteByte(bsonNull)
+		bsonWriteCString(&buf, key)
+	case bool:
+		buf.WriteByte(bsonBool)
+		bsonWriteCString(&buf, key)
+		if v {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case int32:
+		buf.WriteByte(bsonInt32)
+		bsonWriteCString(&buf, key)
+		binary.Write(&buf, binary.LittleEndian, v)
+	case int:
+		buf.WriteByte(bsonInt64)
+		bsonWriteCString(&buf, key)
+		binary.Write(&buf, binary.LittleEndian, int64(v))
+	case int64:
+		buf.WriteByte(bsonInt64)
+		bsonWriteCString(&buf, key)
+		binary.Write(&buf, binary.LittleEndian, v)
+	case float64:
+		buf.WriteByte(bsonDouble)
+		bsonWriteCString(&buf, key)
+		binary.Write(&buf, binary.LittleEndian, v)
+	case string:
+		buf.WriteByte(bsonString)
+		bsonWriteCString(&buf, key)
+		bsonWriteString(&buf, v)
+	case []byte:
+		buf.WriteByte(bsonBinary)
+		bsonWriteCString(&buf, key)
+		binary.Write(&buf, binary.LittleEndian, int32(len(v)))
+		buf.WriteByte(bsonGenericSubtype)
+		buf.Write(v)
+	case time.Time:
+		buf.WriteByte(bsonDatetime)
+		bsonWriteCString(&buf, key)
+		binary.Write(&buf, binary.LittleEndian, v.UnixNano()/int64(time.Millisecond))
+	case ObjectID:
+		buf.WriteByte(bsonObjectID)
+		bsonWriteCString(&buf, key)
+		buf.Write(v[:])
+	case map[string]interface{}:
+		buf.WriteByte(bsonDocument)
+		bsonWriteCString(&buf, key)
+		nested, err := bsonEncodeDocument(v)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(nested)
+	case []interface{}:
+		buf.WriteByte(bsonArray)
+		bsonWriteCString(&buf, key)
+		nested, err := bsonEncodeDocument(v)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(nested)
+	default:
+		return nil, fmt.Errorf("bsonEncodeElement: unsupported type %T for key %q", val, key)
+	}
+	return buf.Bytes(), nil
+}
+
+func bsonWriteCString(buf *bytes.Buffer, s string) {
+	buf.WriteString(s)
+	buf.WriteByte(0x00)
+}
+
+func bsonWriteString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.LittleEndian, int32(len(s)+1))
+	buf.WriteString(s)
+	buf.WriteByte(0x00)
+}
+
+// bsonDecodeDocument decodes one BSON document starting at offset, returning
+// the decoded value (always a map[string]interface{}) and the offset just
+// past it. Use bsonDecodeContainer to decode a document or array element,
+// which knows - from the element's own type tag - which of the two to
+// produce instead of guessing from the field names.
+func bsonDecodeDocument(raw []byte, offset int) (interface{}, int, error) {
+	fields, end, err := bsonDecodeFields(raw, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	return fields, end, nil
+}
+
+// bsonDecodeContainer decodes a document or array element. elemType is the
+// tag written alongside the element (bsonDocument or bsonArray) - that tag,
+// not a guess from the field names, is what tells an empty or
+// numerically-keyed document apart from an array.
+func bsonDecodeContainer(elemType byte, raw []byte, offset int) (interface{}, int, error) {
+	fields, end, err := bsonDecodeFields(raw, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if elemType == bsonArray {
+		return bsonFieldsAsArray(fields), end, nil
+	}
+	return fields, end, nil
+}
+
+// bsonDecodeFields parses the element list common to both documents and
+// arrays, returning them as a map keyed by field name (numeric for arrays).
+func bsonDecodeFields(raw []byte, offset int) (map[string]interface{}, int, error) {
+	if offset+4 > len(raw) {
+		return nil, 0, fmt.Errorf("bsonDecodeDocument: truncated length prefix")
+	}
+	total := int(int32(binary.LittleEndian.Uint32(raw[offset : offset+4])))
+	if total < 5 || offset+total > len(raw) {
+		return nil, 0, fmt.Errorf("bsonDecodeDocument: truncated document")
+	}
+	pos := offset + 4
+	end := offset + total - 1 // position of the terminating 0x00
+	fields := make(map[string]interface{})
+	for pos < end {
+		elemType := raw[pos]
+		pos++
+		key, newPos, err := bsonReadCString(raw, pos)
+		if err != nil {
+			return nil, 0, err
+		}
+		pos = newPos
+		val, newPos, err := bsonDecodeValue(elemType, raw, pos)
+		if err != nil {
+			return nil, 0, err
+		}
+		pos = newPos
+		fields[key] = val
+	}
+	return fields, offset + total, nil
+}
+
+// bsonFieldsAsArray orders an array element's fields by their numeric key
+// ("0", "1", ...) as written by bsonEncodeDocument's []interface{} branch.
+func bsonFieldsAsArray(fields map[string]interface{}) []interface{} {
+	arr := make([]interface{}, len(fields))
+	for key, val := range fields {
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(arr) {
+			continue
+		}
+		arr[i] = val
+	}
+	return arr
+}
+
+func bsonReadCString(raw []byte, offset int) (string, int, error) {
+	end := bytes.IndexByte(raw[offset:], 0x00)
+	if end < 0 {
+		return "", 0, fmt.Errorf("bsonReadCString: unterminated string")
+	}
+	return string(raw[offset : offset+end]), offset + end + 1, nil
+}
+
+func bsonDecodeValue(elemType byte, raw []byte, offset int) (interface{}, int, error) {
+	switch elemType {
+	case bsonDouble:
+		if offset+8 > len(raw) {
+			return nil, 0, fmt.Errorf("bsonDecodeValue: truncated double")
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(raw[offset : offset+8])), offset + 8, nil
+	case bsonString:
+		if offset+4 > len(raw) {
+			return nil, 0, fmt.Errorf("bsonDecodeValue: truncated string length")
+		}
+		length := int(int32(binary.LittleEndian.Uint32(raw[offset : offset+4])))
+		start := offset + 4
+		if length < 1 || start+length > len(raw) {
+			return nil, 0, fmt.Errorf("bsonDecodeValue: invalid string length %d", length)
+		}
+		return string(raw[start : start+length-1]), start + length, nil
+	case bsonDocument, bsonArray:
+		return bsonDecodeContainer(elemType, raw, offset)
+	case bsonBinary:
+		if offset+5 > len(raw) {
+			return nil, 0, fmt.Errorf("bsonDecodeValue: truncated binary header")
+		}
+		length := int(int32(binary.LittleEndian.Uint32(raw[offset : offset+4])))
+		start := offset + 5 // length(4) + subtype(1)
+		if length < 0 || start+length > len(raw) {
+			return nil, 0, fmt.Errorf("bsonDecodeValue: invalid binary length %d", length)
+		}
+		return append([]byte(nil), raw[start:start+length]...), start + length, nil
+	case bsonObjectID:
+		if offset+12 > len(raw) {
+			return nil, 0, fmt.Errorf("bsonDecodeValue: truncated object id")
+		}
+		var id ObjectID
+		copy(id[:], raw[offset:offset+12])
+		return id, offset + 12, nil
+	case bsonBool:
+		if offset+1 > len(raw) {
+			return nil, 0, fmt.Errorf("bsonDecodeValue: truncated bool")
+		}
+		return raw[offset] != 0, offset + 1, nil
+	case bsonDatetime:
+		if offset+8 > len(raw) {
+			return nil, 0, fmt.Errorf("bsonDecodeValue: truncated datetime")
+		}
+		millis := int64(binary.LittleEndian.Uint64(raw[offset : offset+8]))
+		return time.Unix(0, millis*int64(time.Millisecond)), offset + 8, nil
+	case bsonNull:
+		return nil, offset, nil
+	case bsonInt32:
+		if offset+4 > len(raw) {
+			return nil, 0, fmt.Errorf("bsonDecodeValue: truncated int32")
+		}
+		return int32(binary.LittleEndian.Uint32(raw[offset : offset+4])), offset + 4, nil
+	case bsonInt64:
+		if offset+8 > len(raw) {
+			return nil, 0, fmt.Errorf("bsonDecodeValue: truncated int64")
+		}
+		return int64(binary.LittleEndian.Uint64(raw[offset : offset+8])), offset + 8, nil
+	default:
+		return nil, 0, fmt.Errorf("bsonDecodeValue: unsupported element type 0x%02x", elemType)
+	}
+}
@@ -0,0 +1,107 @@
+package binprot
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBSONRoundTripMap(t *testing.T) {
+	doc := map[string]interface{}{
+		"name": "tiedot",
+		"age":  int64(12),
+		"tags": []interface{}{"a", "b", "c"},
+	}
+	encoded, err := bsonEncodeDocument(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := bsonDecodeDocument(encoded, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(doc, decoded) {
+		t.Fatalf("round trip mismatch: got %#v, want %#v", decoded, doc)
+	}
+}
+
+// TestBSONRoundTripNumericKeyedMap makes sure a map whose keys happen to be
+// "0", "1", "2" in order still decodes as a map, not an array - the wire
+// format's own document/array type tag decides that, not the key shape.
+func TestBSONRoundTripNumericKeyedMap(t *testing.T) {
+	doc := map[string]interface{}{"0": "zero", "1": "one", "2": "two"}
+	encoded, err := bsonEncodeElement("field", doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := bsonDecodeValue(bsonDocument, encoded[1+len("field")+1:], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, isMap := decoded.(map[string]interface{}); !isMap {
+		t.Fatalf("expected a map[string]interface{}, got %T", decoded)
+	}
+	if !reflect.DeepEqual(doc, decoded) {
+		t.Fatalf("round trip mismatch: got %#v, want %#v", decoded, doc)
+	}
+}
+
+func TestBSONRoundTripArray(t *testing.T) {
+	arr := []interface{}{"x", "y", "z"}
+	encoded, err := bsonEncodeElement("field", arr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := bsonDecodeValue(bsonArray, encoded[1+len("field")+1:], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(arr, decoded) {
+		t.Fatalf("round trip mismatch: got %#v, want %#v", decoded, arr)
+	}
+}
+
+// TestBSONDecodeCorruptStringLength makes sure a corrupted/truncated string
+// length returns a decode error instead of panicking on a negative-length
+// slice expression - exactly the kind of damage Scrub exists to recover
+// from, so the BSON codec must not crash on it.
+func TestBSONDecodeCorruptStringLength(t *testing.T) {
+	var buf []byte
+	buf = append(buf, 0, 0, 0, 0) // length prefix of 0, which is invalid (must be >= 1)
+	if _, _, err := bsonDecodeValue(bsonString, buf, 0); err == nil {
+		t.Fatal("expected an error decoding a corrupted string length, got nil")
+	}
+}
+
+func TestBSONDecodeTruncatedStringLength(t *testing.T) {
+	if _, _, err := bsonDecodeValue(bsonString, []byte{1, 2}, 0); err == nil {
+		t.Fatal("expected an error decoding a truncated string length prefix, got nil")
+	}
+}
+
+// TestBSONDecodeTruncatedFixedSizeValues makes sure every fixed-size
+// bsonDecodeValue branch - not just the variable-length string branch -
+// returns a decode error on truncated input instead of panicking on an
+// out-of-range slice index.
+func TestBSONDecodeTruncatedFixedSizeValues(t *testing.T) {
+	short := []byte{1, 2, 3}
+	for _, elemType := range []byte{bsonDouble, bsonObjectID, bsonDatetime, bsonInt32, bsonInt64} {
+		if _, _, err := bsonDecodeValue(elemType, short, 0); err == nil {
+			t.Fatalf("expected an error decoding truncated element type 0x%02x, got nil", elemType)
+		}
+	}
+	// A bool is a single byte, so only an empty buffer truncates it.
+	if _, _, err := bsonDecodeValue(bsonBool, []byte{}, 0); err == nil {
+		t.Fatalf("expected an error decoding truncated element type 0x%02x, got nil", bsonBool)
+	}
+}
+
+func TestBSONDecodeTruncatedBinary(t *testing.T) {
+	if _, _, err := bsonDecodeValue(bsonBinary, []byte{1, 2, 3}, 0); err == nil {
+		t.Fatal("expected an error decoding a truncated binary header, got nil")
+	}
+	var buf []byte
+	buf = append(buf, 10, 0, 0, 0, bsonGenericSubtype) // claims 10 bytes of payload, has none
+	if _, _, err := bsonDecodeValue(bsonBinary, buf, 0); err == nil {
+		t.Fatal("expected an error decoding a binary value whose length exceeds the buffer, got nil")
+	}
+}
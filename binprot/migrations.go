@@ -0,0 +1,428 @@
+// Binary protocol over IPC - schema versioning and migrations (client).
+
+package binprot
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/db"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+// schemaVersionCol is the collection used to record which migration
+// version a workspace is currently at.
+const schemaVersionCol = "_schema_version"
+
+// Migration is one ordered schema change a caller registers up front;
+// client.Migrate applies or reverts them in Version order.
+type Migration struct {
+	Version int
+	Up      func(*BinProtClient) error
+	Down    func(*BinProtClient) error
+}
+
+// schemaVersionRecord is the single document stored in schemaVersionCol.
+type schemaVersionRecord struct {
+	Version   int    `json:"version"`
+	AppliedAt int64  `json:"appliedAt"`
+	Checksum  string `json:"checksum"`
+}
+
+var (
+	registeredMigrations   []Migration
+	registeredMigrationsMu sync.Mutex
+)
+
+// migrationLocks serializes Migrate calls per workspace. Migrate cannot hold
+// client.reqMaintAccess for its whole body, because DiffMigration-generated
+// (and any other) Up/Down steps call Create/Index/Unindex/Drop, which each
+// acquire reqMaintAccess themselves - nesting it would deadlock. A plain
+// per-workspace mutex gets the same "one migration at a time" guarantee
+// without requiring reqMaintAccess to be reentrant.
+var (
+	migrationLocks   = make(map[string]*sync.Mutex)
+	migrationLocksMu sync.Mutex
+)
+
+func (client *BinProtClient) migrationLock() *sync.Mutex {
+	migrationLocksMu.Lock()
+	defer migrationLocksMu.Unlock()
+	if migrationLocks[client.workspace] == nil {
+		migrationLocks[client.workspace] = &sync.Mutex{}
+	}
+	return migrationLocks[client.workspace]
+}
+
+// RegisterMigration adds m to the set of known migrations. It is meant to
+// be called from package init() functions before any client.Migrate call.
+func RegisterMigration(m Migration) {
+	registeredMigrationsMu.Lock()
+	defer registeredMigrationsMu.Unlock()
+	for _, existing := range registeredMigrations {
+		if existing.Version == m.Version {
+			tdlog.Panicf("RegisterMigration: version %d is already registered", m.Version)
+		}
+	}
+	registeredMigrations = append(registeredMigrations, m)
+	sort.Slice(registeredMigrations, func(i, j int) bool {
+		return registeredMigrations[i].Version < registeredMigrations[j].Version
+	})
+}
+
+// migrationChecksum fingerprints a migration's actual content - its Version
+// together with its Up and Down function identities - so a stored version
+// record can be told apart from one produced by a different, conflicting
+// migration that merely happens to share the same Version number.
+func migrationChecksum(m Migration) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%d:%s:%s", m.Version, funcName(m.Up), funcName(m.Down))))
+	return hex.EncodeToString(sum[:])
+}
+
+// funcName resolves a migration step function's identity via the runtime,
+// distinguishing two functions registered under the same Version - it
+// returns "" for nil, which is the case once a version has been fully
+// reverted and no migration covers it any more.
+func funcName(fn func(*BinProtClient) error) string {
+	if fn == nil {
+		return ""
+	}
+	return runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
+}
+
+// migrationByVersion finds the registered migration for version, if any -
+// used to fingerprint the version record written after Migrate reaches it.
+func migrationByVersion(version int) (Migration, bool) {
+	registeredMigrationsMu.Lock()
+	defer registeredMigrationsMu.Unlock()
+	for _, m := range registeredMigrations {
+		if m.Version == version {
+			return m, true
+		}
+	}
+	return Migration{}, false
+}
+
+// rank0DB opens the first shard, which is where the single schema version
+// document lives - it has no per-rank content and does not need sharding.
+func (client *BinProtClient) rank0DB() (*db.DB, error) {
+	return db.OpenDB(client.workspace + "/0")
+}
+
+// currentVersionRecord reads the latest schema version document, or a zero
+// record if schemaVersionCol does not exist yet or is still empty.
+func (client *BinProtClient) currentVersionRecord() (schemaVersionRecord, error) {
+	rankDB, err := client.rank0DB()
+	if err != nil {
+		return schemaVersionRecord{}, err
+	}
+	defer rankDB.Close()
+	col := rankDB.Use(schemaVersionCol)
+	if col == nil {
+		return schemaVersionRecord{}, nil
+	}
+	latest := schemaVersionRecord{}
+	err = col.ForEachDoc(func(id int, docContent []byte) bool {
+		rec, decodeErr := decodeSchemaVersionRecord(docContent)
+		if decodeErr == nil && rec.Version > latest.Version {
+			latest = rec
+		}
+		return true
+	})
+	return latest, err
+}
+
+// writeVersionRecord records that the workspace is now at version, updating
+// the existing schema version document in place (or inserting it if there
+// is none yet) so that a lower version written by a Down step is not
+// outranked by an older, higher record.
+func (client *BinProtClient) writeVersionRecord(version int) error {
+	rankDB, err := client.rank0DB()
+	if err != nil {
+		return err
+	}
+	defer rankDB.Close()
+	if rankDB.Use(schemaVersionCol) == nil {
+		if err := rankDB.Create(schemaVersionCol); err != nil {
+			return err
+		}
+	}
+	m, found := migrationByVersion(version)
+	if !found {
+		m = Migration{Version: version}
+	}
+	rec := schemaVersionRecord{Version: version, AppliedAt: time.Now().Unix(), Checksum: migrationChecksum(m)}
+	doc, err := schemaVersionRecordToDoc(rec)
+	if err != nil {
+		return err
+	}
+	col := rankDB.Use(schemaVersionCol)
+	existingIDs := make([]int, 0, 1)
+	if err := col.ForEachDoc(func(id int, docContent []byte) bool {
+		existingIDs = append(existingIDs, id)
+		return true
+	}); err != nil {
+		return err
+	}
+	if len(existingIDs) == 0 {
+		_, err = col.Insert(doc)
+		return err
+	}
+	for _, id := range existingIDs {
+		if err := col.Update(id, doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaVersionRecordToDoc round-trips rec through JSON into the
+// map[string]interface{} shape the document store expects for Insert.
+func schemaVersionRecordToDoc(rec schemaVersionRecord) (map[string]interface{}, error) {
+	encoded, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal(encoded, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func decodeSchemaVersionRecord(docContent []byte) (schemaVersionRecord, error) {
+	rec := schemaVersionRecord{}
+	err := json.Unmarshal(docContent, &rec)
+	return rec, err
+}
+
+// SchemaVersion returns the migration version the workspace is currently
+// at, or 0 if no migration has ever been applied.
+func (client *BinProtClient) SchemaVersion() (int, error) {
+	rec, err := client.currentVersionRecord()
+	if err != nil {
+		return 0, err
+	}
+	return rec.Version, nil
+}
+
+// PendingMigrations returns the registered migration versions greater than
+// the workspace's current schema version, in the order they would apply.
+func (client *BinProtClient) PendingMigrations() ([]int, error) {
+	current, err := client.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	registeredMigrationsMu.Lock()
+	defer registeredMigrationsMu.Unlock()
+	pending := make([]int, 0)
+	for _, m := range registeredMigrations {
+		if m.Version > current {
+			pending = append(pending, m.Version)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate brings the workspace to target, applying Up steps (if target is
+// ahead of the current version) or Down steps (if target is behind). Only
+// one Migrate call runs at a time per workspace; each step it runs acquires
+// its own maintenance access as usual, so Migrate itself does not hold
+// reqMaintAccess across the whole run. If a step fails partway through a
+// multi-step migration, the inverse of every step that already succeeded is
+// run and the version record is restored to what it was before Migrate
+// started. It is an error for target to have no migration covering it.
+func (client *BinProtClient) Migrate(target int) error {
+	lock := client.migrationLock()
+	lock.Lock()
+	defer lock.Unlock()
+	current, err := client.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current == target {
+		return nil
+	}
+	steps, ascending, err := client.migrationSteps(current, target)
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		return fmt.Errorf("Migrate: no registered migration covers the path from version %d to %d", current, target)
+	}
+	if ascending && steps[len(steps)-1].Version != target {
+		return fmt.Errorf("Migrate: no registered migration covers version %d", target)
+	}
+	applied := make([]Migration, 0, len(steps))
+	for _, m := range steps {
+		var stepErr error
+		if ascending {
+			stepErr = m.Up(client)
+		} else {
+			stepErr = m.Down(client)
+		}
+		if stepErr != nil {
+			client.rollbackMigrations(applied, ascending)
+			if writeErr := client.writeVersionRecord(current); writeErr != nil {
+				return fmt.Errorf("Migrate: step %d failed (%v), and failed to restore version record (%v)", m.Version, stepErr, writeErr)
+			}
+			return fmt.Errorf("Migrate: step %d failed and was rolled back - %v", m.Version, stepErr)
+		}
+		applied = append(applied, m)
+		versionAfterStep := m.Version
+		if !ascending {
+			versionAfterStep = target
+			if idx := migrationIndexOf(steps, m); idx < len(steps)-1 {
+				versionAfterStep = steps[idx+1].Version
+			}
+		}
+		if err := client.writeVersionRecord(versionAfterStep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrationSteps returns the ordered migrations to run to get from
+// current to target, and whether they run as Up (ascending) or Down.
+func (client *BinProtClient) migrationSteps(current, target int) ([]Migration, bool, error) {
+	registeredMigrationsMu.Lock()
+	defer registeredMigrationsMu.Unlock()
+	ascending := target > current
+	steps := make([]Migration, 0)
+	for _, m := range registeredMigrations {
+		if ascending && m.Version > current && m.Version <= target {
+			steps = append(steps, m)
+		} else if !ascending && m.Version <= current && m.Version > target {
+			steps = append(steps, m)
+		}
+	}
+	if !ascending {
+		// Down migrations undo the most recently applied version first.
+		for i, j := 0, len(steps)-1; i < j; i, j = i+1, j-1 {
+			steps[i], steps[j] = steps[j], steps[i]
+		}
+	}
+	return steps, ascending, nil
+}
+
+func migrationIndexOf(steps []Migration, m Migration) int {
+	for i, s := range steps {
+		if s.Version == m.Version {
+			return i
+		}
+	}
+	return -1
+}
+
+// rollbackMigrations runs the inverse of every already-applied step, in
+// reverse order, best-effort (a rollback failure is logged, not returned,
+// since the caller already has a primary error to report).
+func (client *BinProtClient) rollbackMigrations(applied []Migration, wasAscending bool) {
+	for i := len(applied) - 1; i >= 0; i-- {
+		m := applied[i]
+		var err error
+		if wasAscending {
+			err = m.Down(client)
+		} else {
+			err = m.Up(client)
+		}
+		if err != nil {
+			tdlog.Noticef("Migrate: failed to roll back migration %d - %v", m.Version, err)
+		}
+	}
+}
+
+// TargetSchema declaratively describes the desired shape of a workspace,
+// for use with DiffMigration.
+type TargetSchema struct {
+	Collections []string
+	Indexes     map[string][][]string
+}
+
+// DiffMigration builds a Migration whose Up creates every collection and
+// index present in target but missing from the workspace - diffed against
+// AllCols/AllIndexes at the time the step actually runs, so it stays
+// correct even if target changes between registration and application.
+// Down unindexes every index path and drops every existing collection that
+// target lists, whether or not Up was the one that created it.
+func DiffMigration(version int, target TargetSchema) Migration {
+	return Migration{
+		Version: version,
+		Up: func(client *BinProtClient) error {
+			for _, colName := range target.Collections {
+				if !containsString(client.AllCols(), colName) {
+					if err := client.Create(colName); err != nil {
+						return err
+					}
+				}
+			}
+			for colName, idxPaths := range target.Indexes {
+				existing, err := client.AllIndexes(colName)
+				if err != nil {
+					return err
+				}
+				for _, idxPath := range idxPaths {
+					if !containsPath(existing, idxPath) {
+						if err := client.Index(colName, idxPath); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			return nil
+		},
+		Down: func(client *BinProtClient) error {
+			for colName, idxPaths := range target.Indexes {
+				for _, idxPath := range idxPaths {
+					if err := client.Unindex(colName, idxPath); err != nil {
+						return err
+					}
+				}
+			}
+			for _, colName := range target.Collections {
+				if containsString(client.AllCols(), colName) {
+					if err := client.Drop(colName); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	}
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPath(haystack [][]string, needle []string) bool {
+	for _, path := range haystack {
+		if len(path) != len(needle) {
+			continue
+		}
+		match := true
+		for i := range path {
+			if path[i] != needle[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
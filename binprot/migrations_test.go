@@ -0,0 +1,77 @@
+package binprot
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMigrationChecksumDiffersByVersion(t *testing.T) {
+	a := Migration{Version: 1}
+	b := Migration{Version: 2}
+	if migrationChecksum(a) == migrationChecksum(b) {
+		t.Fatal("expected different versions to produce different checksums")
+	}
+	if migrationChecksum(a) != migrationChecksum(a) {
+		t.Fatal("expected the same migration to produce a stable checksum")
+	}
+}
+
+// TestMigrationChecksumDiffersByContent makes sure two migrations that
+// happen to share the same Version - the exact conflict a checksum exists
+// to detect - produce different checksums, since they fingerprint distinct
+// Up/Down functions rather than just the Version number.
+func TestMigrationChecksumDiffersByContent(t *testing.T) {
+	a := Migration{
+		Version: 5,
+		Up:      func(c *BinProtClient) error { return nil },
+		Down:    func(c *BinProtClient) error { return nil },
+	}
+	b := Migration{
+		Version: 5,
+		Up:      func(c *BinProtClient) error { return fmt.Errorf("different migration") },
+		Down:    func(c *BinProtClient) error { return nil },
+	}
+	if migrationChecksum(a) == migrationChecksum(b) {
+		t.Fatal("expected conflicting migrations sharing a version to produce different checksums")
+	}
+}
+
+func TestContainsStringAndPath(t *testing.T) {
+	if !containsString([]string{"a", "b"}, "b") {
+		t.Fatal("expected containsString to find an existing element")
+	}
+	if containsString([]string{"a", "b"}, "c") {
+		t.Fatal("expected containsString to report a missing element as absent")
+	}
+	paths := [][]string{{"a", "b"}, {"c"}}
+	if !containsPath(paths, []string{"a", "b"}) {
+		t.Fatal("expected containsPath to find an existing path")
+	}
+	if containsPath(paths, []string{"a"}) {
+		t.Fatal("expected containsPath to reject a path of different length")
+	}
+}
+
+// TestMigrationStepsRejectsUncoveredTarget exercises the pure step-selection
+// logic Migrate relies on to refuse silently no-oping when no registered
+// migration actually covers the requested target.
+func TestMigrationStepsRejectsUncoveredTarget(t *testing.T) {
+	registeredMigrationsMu.Lock()
+	saved := registeredMigrations
+	registeredMigrations = nil
+	registeredMigrationsMu.Unlock()
+	defer func() {
+		registeredMigrationsMu.Lock()
+		registeredMigrations = saved
+		registeredMigrationsMu.Unlock()
+	}()
+
+	client := &BinProtClient{}
+	steps, _, err := client.migrationSteps(0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 0 {
+		t.Fatalf("expected no steps with nothing registered, got %d", len(steps))
+	}
+}
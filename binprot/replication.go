@@ -0,0 +1,564 @@
+// Binary protocol over IPC - command-log based replication (client).
+
+package binprot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+// Replication log opcodes - each mirrors a logical schema/maintenance
+// operation rather than a physical file diff, so that a replica can reach
+// the same schema via its own forAllDBsDo instead of byte-for-byte copying.
+const (
+	OP_CREATE_COL uint8 = iota
+	OP_RENAME_COL
+	OP_TRUNCATE_COL
+	OP_DROP_COL
+	OP_INDEX
+	OP_UNINDEX
+	OP_SCRUB
+	// Document mutation opcodes were added after the schema opcodes above,
+	// and must stay appended in this order: the opcode value is durably
+	// recorded in on-disk segments, so renumbering an existing one would
+	// make every log written before this point undecodable.
+	OP_DOC_INSERT
+	OP_DOC_UPDATE
+	OP_DOC_DELETE
+)
+
+// replSegmentMaxSize is the size at which the active segment is rotated.
+const replSegmentMaxSize = 64 * 1024 * 1024
+
+const replSegmentPrefix = "repl-"
+const replSegmentSuffix = ".log"
+
+// Command is one framed, ordered mutation recorded in a ReplicationLog.
+type Command struct {
+	LSN     uint64
+	Opcode  uint8
+	Payload []byte
+}
+
+// ReplicationLog is an append-only, fsync'd sequence of Commands stored as
+// a series of rotating segment files under a workspace's "replication"
+// directory. Every mutating client call appends to it before acking.
+type ReplicationLog struct {
+	dir        string
+	mu         sync.Mutex
+	segment    *os.File
+	segmentSeq int
+	segmentLen int64
+	lastLSN    uint64
+}
+
+// replicationLogs maps a client's workspace to its open ReplicationLog, so
+// that BinProtClient (defined elsewhere in the package) does not need a new
+// struct field to carry a reference to it around.
+var (
+	replicationLogs   = make(map[string]*ReplicationLog)
+	replicationLogsMu sync.Mutex
+)
+
+// replicationLog returns (opening or creating it on first use) the
+// ReplicationLog backing this client's workspace.
+func (client *BinProtClient) replicationLog() (*ReplicationLog, error) {
+	replicationLogsMu.Lock()
+	defer replicationLogsMu.Unlock()
+	if log, exists := replicationLogs[client.workspace]; exists {
+		return log, nil
+	}
+	log, err := openReplicationLog(path.Join(client.workspace, "replication"))
+	if err != nil {
+		return nil, err
+	}
+	replicationLogs[client.workspace] = log
+	return log, nil
+}
+
+// openReplicationLog opens (creating if necessary) the replication
+// directory, resuming from the highest-numbered existing segment and LSN.
+func openReplicationLog(dir string) (*ReplicationLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	segments, err := replSegmentFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	log := &ReplicationLog{dir: dir}
+	if len(segments) == 0 {
+		if err := log.openSegment(0); err != nil {
+			return nil, err
+		}
+		return log, nil
+	}
+	lastSeq := segments[len(segments)-1]
+	if err := log.openSegment(lastSeq); err != nil {
+		return nil, err
+	}
+	lastLSN, err := replLastLSNInSegment(log.segment)
+	if err != nil {
+		return nil, err
+	}
+	log.lastLSN = lastLSN
+	info, err := log.segment.Stat()
+	if err != nil {
+		return nil, err
+	}
+	log.segmentLen = info.Size()
+	return log, nil
+}
+
+// replSegmentFiles returns the sequence numbers of every segment file in
+// dir, sorted ascending.
+func replSegmentFiles(dir string) ([]int, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	seqs := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, replSegmentPrefix) || !strings.HasSuffix(name, replSegmentSuffix) {
+			continue
+		}
+		seqStr := strings.TrimSuffix(strings.TrimPrefix(name, replSegmentPrefix), replSegmentSuffix)
+		seq, err := strconv.Atoi(seqStr)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
+
+func replSegmentPath(dir string, seq int) string {
+	return path.Join(dir, fmt.Sprintf("%s%d%s", replSegmentPrefix, seq, replSegmentSuffix))
+}
+
+func (log *ReplicationLog) openSegment(seq int) error {
+	f, err := os.OpenFile(replSegmentPath(log.dir, seq), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if log.segment != nil {
+		log.segment.Close()
+	}
+	log.segment = f
+	log.segmentSeq = seq
+	log.segmentLen = 0
+	return nil
+}
+
+// replLastLSNInSegment scans a segment file and returns the LSN of its
+// last well-formed record, or 0 if the segment is empty.
+func replLastLSNInSegment(f *os.File) (uint64, error) {
+	cmds, _, err := readCommandsFrom(f, 0)
+	if err != nil {
+		return 0, err
+	}
+	if len(cmds) == 0 {
+		return 0, nil
+	}
+	return cmds[len(cmds)-1].LSN, nil
+}
+
+// Append writes cmd's opcode and payload as the next Command, fsyncing the
+// segment before returning so callers can safely ack the mutation to the
+// requester only after it is durable.
+func (log *ReplicationLog) Append(opcode uint8, payload []byte) (uint64, error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if log.segmentLen >= replSegmentMaxSize {
+		if err := log.openSegment(log.segmentSeq + 1); err != nil {
+			return 0, err
+		}
+	}
+	log.lastLSN++
+	cmd := Command{LSN: log.lastLSN, Opcode: opcode, Payload: payload}
+	n, err := writeCommand(log.segment, cmd)
+	if err != nil {
+		return 0, err
+	}
+	if err := log.segment.Sync(); err != nil {
+		return 0, err
+	}
+	log.segmentLen += int64(n)
+	return cmd.LSN, nil
+}
+
+// writeCommand frames cmd as: 8-byte LSN, 1-byte opcode, 4-byte payload
+// length, payload bytes. It returns the number of bytes written.
+func writeCommand(f *os.File, cmd Command) (int, error) {
+	frame := make([]byte, 8+1+4+len(cmd.Payload))
+	copy(frame[0:8], Buint64(cmd.LSN))
+	frame[8] = cmd.Opcode
+	copy(frame[9:13], Bint32(int32(len(cmd.Payload))))
+	copy(frame[13:], cmd.Payload)
+	if _, err := f.Seek(0, os.SEEK_END); err != nil {
+		return 0, err
+	}
+	return f.Write(frame)
+}
+
+// readCommandsFrom reads every well-formed Command from f starting at
+// fromOffset, also returning the offset just past the last complete record
+// read - callers that poll repeatedly (FollowFrom) pass this back in as the
+// next fromOffset so each poll only re-reads what is actually new. A
+// truncated trailing record (e.g. a crash mid-write, or a reader racing an
+// in-progress Append) is silently left unread rather than treated as an
+// error; it will be picked up whole on a later call once it is complete.
+func readCommandsFrom(f *os.File, fromOffset int64) ([]Command, int64, error) {
+	if _, err := f.Seek(fromOffset, os.SEEK_SET); err != nil {
+		return nil, fromOffset, err
+	}
+	cmds := make([]Command, 0)
+	offset := fromOffset
+	header := make([]byte, 13)
+	for {
+		if _, err := readFull(f, header); err != nil {
+			break
+		}
+		payloadLen := int(parseUint32(header[9:13]))
+		payload := make([]byte, payloadLen)
+		if _, err := readFull(f, payload); err != nil {
+			break
+		}
+		cmds = append(cmds, Command{
+			LSN:     parseUint64(header[0:8]),
+			Opcode:  header[8],
+			Payload: payload,
+		})
+		offset += int64(len(header) + payloadLen)
+	}
+	return cmds, offset, nil
+}
+
+func parseUint32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+func parseUint64(b []byte) uint64 {
+	var v uint64
+	for _, by := range b {
+		v = v<<8 | uint64(by)
+	}
+	return v
+}
+
+func readFull(f *os.File, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := f.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, fmt.Errorf("short read")
+		}
+	}
+	return total, nil
+}
+
+// Truncate removes every segment whose highest LSN is below beforeLSN,
+// freeing disk space once those commands have been applied everywhere.
+func (log *ReplicationLog) Truncate(beforeLSN uint64) error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	segments, err := replSegmentFiles(log.dir)
+	if err != nil {
+		return err
+	}
+	for _, seq := range segments {
+		if seq == log.segmentSeq {
+			continue // never remove the active segment
+		}
+		f, err := os.Open(replSegmentPath(log.dir, seq))
+		if err != nil {
+			return err
+		}
+		lastLSN, err := replLastLSNInSegment(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if lastLSN < beforeLSN {
+			if err := os.Remove(replSegmentPath(log.dir, seq)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// appendReplCommand is a convenience used by the maintenance methods below:
+// marshal payload to JSON and append it as opcode to the client's log.
+func (client *BinProtClient) appendReplCommand(opcode uint8, payload interface{}) error {
+	log, err := client.replicationLog()
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = log.Append(opcode, encoded)
+	return err
+}
+
+// commitReplication appends opcode/payload to the replication log after its
+// corresponding mutation has already succeeded everywhere it needed to. If
+// the append itself fails - e.g. the log's disk is full or fsync errors -
+// rollback (when given) best-effort undoes the mutation, so a replication
+// failure never leaves the workspace changed with nothing recording why:
+// callers that already have a shard-level rollback closure (Create, Rename,
+// Index, ...) pass it through here; callers with nothing safe to roll back
+// (Truncate, Drop, Unindex, Scrub's final swap) pass nil, same as they
+// already do for forAllDBsDo's own ShardOpts.Rollback.
+func (client *BinProtClient) commitReplication(opcode uint8, payload interface{}, rollback func() error) error {
+	if err := client.appendReplCommand(opcode, payload); err != nil {
+		if rollback == nil {
+			return fmt.Errorf("replication log append failed (mutation not rolled back): %v", err)
+		}
+		if rbErr := rollback(); rbErr != nil {
+			tdlog.Noticef("commitReplication: rollback after replication append failure also failed - %v", rbErr)
+			return fmt.Errorf("replication log append failed (rollback also failed - %v): %v", rbErr, err)
+		}
+		return fmt.Errorf("replication log append failed (mutation rolled back): %v", err)
+	}
+	return nil
+}
+
+// FollowFrom tails this client's replication log starting after lsn,
+// delivering every new Command on the returned channel as it is appended.
+// Segments are polled rather than watched via inotify, matching the rest
+// of the package's preference for simple, portable IO. Each segment's read
+// offset is remembered between polls, so a poll only re-reads the bytes
+// appended since the last one rather than the whole segment history. A
+// transient error opening or reading a segment - including the ordinary
+// race of Truncate removing an already-applied segment out from under this
+// loop - is logged and retried on the next poll instead of permanently
+// closing the returned channel.
+//
+// Closing stop ends the follower goroutine and the returned channel, even
+// mid-delivery - without it, a caller that stops draining the channel (a
+// replica shutting down, an error path) would leave the goroutine blocked
+// forever on its next send.
+func (client *BinProtClient) FollowFrom(lsn uint64, stop <-chan struct{}) (<-chan Command, error) {
+	log, err := client.replicationLog()
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan Command)
+	go func() {
+		defer close(out)
+		after := lsn
+		offsets := make(map[int]int64)
+		for {
+			segments, err := replSegmentFiles(log.dir)
+			if err != nil {
+				tdlog.Noticef("FollowFrom: failed to list segments, will retry - %v", err)
+				if !sleepOrStop(200*time.Millisecond, stop) {
+					return
+				}
+				continue
+			}
+			for _, seq := range segments {
+				f, err := os.Open(replSegmentPath(log.dir, seq))
+				if os.IsNotExist(err) {
+					// Truncate raced us and removed this already-applied
+					// segment - there is nothing new left to read from it.
+					delete(offsets, seq)
+					continue
+				} else if err != nil {
+					// Stop this poll here: reading later segments first would
+					// advance past this segment's commands and skip them.
+					tdlog.Noticef("FollowFrom: failed to open segment %d, will retry - %v", seq, err)
+					break
+				}
+				cmds, nextOffset, err := readCommandsFrom(f, offsets[seq])
+				f.Close()
+				if err != nil {
+					tdlog.Noticef("FollowFrom: failed to read segment %d, will retry - %v", seq, err)
+					break
+				}
+				offsets[seq] = nextOffset
+				for _, cmd := range cmds {
+					if cmd.LSN <= after {
+						continue
+					}
+					select {
+					case out <- cmd:
+						after = cmd.LSN
+					case <-stop:
+						return
+					}
+				}
+			}
+			if !sleepOrStop(200*time.Millisecond, stop) {
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// sleepOrStop waits for d, returning false early if stop is closed first -
+// used by FollowFrom's poll loop so a caller asking it to stop doesn't have
+// to wait out the rest of the current poll interval.
+func sleepOrStop(d time.Duration, stop <-chan struct{}) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// ReplicaApplier replays Commands read from a primary's replication log
+// against a local replica's BinProtClient, tracking the last applied LSN
+// in a small metadata file so that restarting an applier is idempotent.
+type ReplicaApplier struct {
+	remote      *BinProtClient
+	metaPath    string
+	lastApplied uint64
+}
+
+// NewReplicaApplier opens (or creates) metaPath and returns an applier
+// that will replay commands onto remote, skipping any LSN already applied.
+func NewReplicaApplier(remote *BinProtClient, metaPath string) (*ReplicaApplier, error) {
+	applier := &ReplicaApplier{remote: remote, metaPath: metaPath}
+	content, err := ioutil.ReadFile(metaPath)
+	if os.IsNotExist(err) {
+		return applier, nil
+	} else if err != nil {
+		return nil, err
+	}
+	lastApplied, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	applier.lastApplied = lastApplied
+	return applier, nil
+}
+
+// Run applies every Command received from commands in order, persisting
+// progress after each one so a crash mid-stream resumes without replay.
+func (applier *ReplicaApplier) Run(commands <-chan Command) error {
+	for cmd := range commands {
+		if err := applier.Apply(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply replays a single Command against the replica, no-op'ing commands
+// at or below the last applied LSN so re-delivery is always safe.
+func (applier *ReplicaApplier) Apply(cmd Command) error {
+	if cmd.LSN <= applier.lastApplied {
+		return nil
+	}
+	if err := applier.dispatch(cmd); err != nil {
+		return err
+	}
+	applier.lastApplied = cmd.LSN
+	return ioutil.WriteFile(applier.metaPath, []byte(strconv.FormatUint(cmd.LSN, 10)), 0600)
+}
+
+func (applier *ReplicaApplier) dispatch(cmd Command) error {
+	switch cmd.Opcode {
+	case OP_CREATE_COL:
+		var payload struct{ Name, Codec string }
+		if err := json.Unmarshal(cmd.Payload, &payload); err != nil {
+			return err
+		}
+		return applier.remote.Create(payload.Name, CreateOpts{Codec: payload.Codec})
+	case OP_RENAME_COL:
+		var payload struct{ OldName, NewName string }
+		if err := json.Unmarshal(cmd.Payload, &payload); err != nil {
+			return err
+		}
+		return applier.remote.Rename(payload.OldName, payload.NewName)
+	case OP_TRUNCATE_COL:
+		var payload struct{ Name string }
+		if err := json.Unmarshal(cmd.Payload, &payload); err != nil {
+			return err
+		}
+		return applier.remote.Truncate(payload.Name)
+	case OP_DROP_COL:
+		var payload struct{ Name string }
+		if err := json.Unmarshal(cmd.Payload, &payload); err != nil {
+			return err
+		}
+		return applier.remote.Drop(payload.Name)
+	case OP_INDEX:
+		var payload struct {
+			Col  string
+			Path []string
+		}
+		if err := json.Unmarshal(cmd.Payload, &payload); err != nil {
+			return err
+		}
+		return applier.remote.Index(payload.Col, payload.Path)
+	case OP_UNINDEX:
+		var payload struct {
+			Col  string
+			Path []string
+		}
+		if err := json.Unmarshal(cmd.Payload, &payload); err != nil {
+			return err
+		}
+		return applier.remote.Unindex(payload.Col, payload.Path)
+	case OP_SCRUB:
+		var payload struct{ Name string }
+		if err := json.Unmarshal(cmd.Payload, &payload); err != nil {
+			return err
+		}
+		return applier.remote.Scrub(payload.Name)
+	case OP_DOC_INSERT:
+		var payload struct {
+			Col string
+			ID  int
+			Doc map[string]interface{}
+		}
+		if err := json.Unmarshal(cmd.Payload, &payload); err != nil {
+			return err
+		}
+		return applier.remote.applyInsertAt(payload.Col, payload.ID, payload.Doc)
+	case OP_DOC_UPDATE:
+		var payload struct {
+			Col string
+			ID  int
+			Doc map[string]interface{}
+		}
+		if err := json.Unmarshal(cmd.Payload, &payload); err != nil {
+			return err
+		}
+		return applier.remote.applyUpdate(payload.Col, payload.ID, payload.Doc)
+	case OP_DOC_DELETE:
+		var payload struct {
+			Col string
+			ID  int
+		}
+		if err := json.Unmarshal(cmd.Payload, &payload); err != nil {
+			return err
+		}
+		return applier.remote.applyDelete(payload.Col, payload.ID)
+	default:
+		return fmt.Errorf("ReplicaApplier: unknown opcode %d at LSN %d", cmd.Opcode, cmd.LSN)
+	}
+}
@@ -0,0 +1,126 @@
+// Binary protocol over IPC - bounded-concurrency shard fan-out (client).
+
+package binprot
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/db"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+// ShardOpts controls how forAllDBsDo fans a function out across shards.
+type ShardOpts struct {
+	// Concurrency is how many shards run fun at once. Zero means
+	// runtime.NumCPU().
+	Concurrency int
+	// Rollback, if set, is invoked (best-effort) on every shard that
+	// completed fun successfully, whenever any other shard failed -
+	// e.g. Drop(colName) after a partial Create, or Unindex(path) after
+	// a partial Index.
+	Rollback func(i int, clientDB *db.DB) error
+}
+
+// multiError joins every shard's failure into a single error, so callers
+// see the full picture instead of just whichever shard happened to be
+// collected first.
+type multiError struct {
+	errs  []error
+	total int
+}
+
+func (m *multiError) Error() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d of %d shard(s) failed:", len(m.errs), m.total)
+	for _, err := range m.errs {
+		fmt.Fprintf(&buf, "\n  - %v", err)
+	}
+	return buf.String()
+}
+
+type shardResult struct {
+	rank int
+	err  error
+	took time.Duration
+}
+
+// forAllDBsDo runs fun once per rank shard of the workspace, using a pool
+// of opts.Concurrency worker goroutines so shards are processed
+// concurrently rather than one after another. If any shard's fun fails,
+// every error is collected into a *multiError, and opts.Rollback (when
+// given) is run on each shard that had already succeeded so the DB does
+// not end up partially changed.
+func (client *BinProtClient) forAllDBsDo(fun func(i int, clientDB *db.DB) error, opts ShardOpts) error {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	if concurrency > client.nProcs {
+		concurrency = client.nProcs
+	}
+	ranks := make(chan int)
+	results := make(chan shardResult)
+	var workers sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for rank := range ranks {
+				start := time.Now()
+				err := client.runOnShard(rank, fun)
+				results <- shardResult{rank: rank, err: err, took: time.Since(start)}
+			}
+		}()
+	}
+	go func() {
+		for rank := 0; rank < client.nProcs; rank++ {
+			ranks <- rank
+		}
+		close(ranks)
+	}()
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+	succeeded := make([]int, 0, client.nProcs)
+	merr := &multiError{errs: make([]error, 0, client.nProcs), total: client.nProcs}
+	for result := range results {
+		tdlog.Noticef("forAllDBsDo: shard %d took %s", result.rank, result.took)
+		if result.err != nil {
+			merr.errs = append(merr.errs, fmt.Errorf("shard %d: %v", result.rank, result.err))
+		} else {
+			succeeded = append(succeeded, result.rank)
+		}
+	}
+	if len(merr.errs) == 0 {
+		return nil
+	}
+	if opts.Rollback != nil {
+		for _, rank := range succeeded {
+			if err := client.runOnShard(rank, opts.Rollback); err != nil {
+				tdlog.Noticef("forAllDBsDo: rollback failed on shard %d - %v", rank, err)
+			}
+		}
+	}
+	return merr
+}
+
+// runOnShard opens, runs fun against, and closes the DB belonging to one
+// rank shard.
+func (client *BinProtClient) runOnShard(rank int, fun func(i int, clientDB *db.DB) error) error {
+	clientDB, err := db.OpenDB(path.Join(client.workspace, strconv.Itoa(rank)))
+	if err != nil {
+		return err
+	}
+	if err := fun(rank, clientDB); err != nil {
+		clientDB.Close()
+		return err
+	}
+	return clientDB.Close()
+}
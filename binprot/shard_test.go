@@ -0,0 +1,21 @@
+package binprot
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMultiErrorMessageListsEveryShardFailure(t *testing.T) {
+	merr := &multiError{
+		errs:  []error{errors.New("shard 0: boom"), errors.New("shard 2: kaboom")},
+		total: 4,
+	}
+	msg := merr.Error()
+	if !strings.Contains(msg, "2 of 4 shard(s) failed") {
+		t.Fatalf("expected a summary count in %q", msg)
+	}
+	if !strings.Contains(msg, "boom") || !strings.Contains(msg, "kaboom") {
+		t.Fatalf("expected every shard's failure in %q", msg)
+	}
+}